@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildLogRecord is the last known successful execution of a task, as
+// persisted to a dag's .buildlog file.
+type buildLogRecord struct {
+	Name        string
+	CommandHash string
+	InputHash   string
+	Start       time.Time
+	Duration    time.Duration
+}
+
+// buildLog is the set of buildLogRecords for a dag, keyed by task name.
+type buildLog map[string]*buildLogRecord
+
+// loadBuildLog reads a dag's build log from disk. A missing file (e.g. the
+// first time a dag is run) is not an error and yields an empty buildLog.
+func loadBuildLog(path string) (buildLog, error) {
+	bl := buildLog{}
+	if path == "" {
+		return bl, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return bl, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	rec := &buildLogRecord{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			if rec.Name != "" {
+				bl[rec.Name] = rec
+			}
+			rec = &buildLogRecord{}
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed build log line %q", line)
+		}
+		switch key {
+		case "Name":
+			rec.Name = value
+		case "Command":
+			rec.CommandHash = value
+		case "Inputs":
+			rec.InputHash = value
+		case "Start":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, err
+			}
+			rec.Start = t
+		case "Duration":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			rec.Duration = d
+		default:
+			return nil, fmt.Errorf("unknown build log key %q", key)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if rec.Name != "" {
+		bl[rec.Name] = rec
+	}
+	return bl, nil
+}
+
+// save writes the build log to disk, one record per task sorted by name so
+// the file diffs cleanly across runs.
+func (bl buildLog) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	names := make([]string, 0, len(bl))
+	for name := range bl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i, name := range names {
+		rec := bl[name]
+		if i > 0 {
+			if _, err := fmt.Fprint(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "Name: %s\n", rec.Name); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "Command: %s\n", rec.CommandHash); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "Inputs: %s\n", rec.InputHash); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "Start: %s\n", rec.Start.Format(time.RFC3339Nano)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "Duration: %s\n", rec.Duration); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// matches reports whether a task's current command and inputs are identical
+// to what last produced this record, meaning it can be skipped. A task with
+// a <dep-always/> edge never matches, so it is always rerun.
+func (rec *buildLogRecord) matches(t *task, cacheDir string) bool {
+	if t.Always != nil {
+		return false
+	}
+	cmdHash := t.commandHash(cacheDir)
+	inputHash, err := t.inputHash(cacheDir)
+	if err != nil {
+		return false
+	}
+	return rec.CommandHash == cmdHash && rec.InputHash == inputHash
+}
+
+// commandHash hashes the task's rendered command.
+func (t *task) commandHash(cacheDir string) string {
+	return hashBytes([]byte(t.command(cacheDir)))
+}
+
+// inputHash hashes the concatenation of the content hashes of every <file>
+// and cached <fetch> artifact the task depends on (each <fetch> also
+// contributes its declared sha256 pin, so bumping the pin invalidates the
+// hash even if the cache dir still holds bytes matching the old one), plus
+// whether each <dep-ifcreate> path currently exists, so a task is rebuilt
+// the first run after one of those paths comes into being.
+func (t *task) inputHash(cacheDir string) (string, error) {
+	h := sha256.New()
+	for _, f := range t.Files {
+		fh, err := hashFile(f)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(h, fh); err != nil {
+			return "", err
+		}
+	}
+	for _, ft := range t.Fetches {
+		fh, err := hashFile(ft.path(cacheDir))
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(h, fh); err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(h, ft.SHA256); err != nil {
+			return "", err
+		}
+	}
+	for _, p := range t.IfCreate {
+		state := "absent"
+		if _, err := os.Stat(p); err == nil {
+			state = "present"
+		}
+		if _, err := io.WriteString(h, state); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the hex-encoded SHA256 of a file's contents.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashBytes returns the hex-encoded SHA256 of b.
+func hashBytes(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -2,23 +2,33 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type dag struct {
 	Name  string  `xml:"name,attr"`
 	Tasks []*task `xml:"task"`
+
+	buildLog     buildLog
+	buildLogPath string
+	cacheDir     string
 }
 
 // writeDot ...
-func (d *dag) writeDot(w io.Writer) error {
+func (d *dag) writeDot(out io.Writer) error {
+	w := bufio.NewWriter(out)
 	if _, err := fmt.Fprintf(w, "digraph %s {\n", d.Name); err != nil {
 		return err
 	}
@@ -41,12 +51,161 @@ func (d *dag) writeDot(w io.Writer) error {
 	if _, err := fmt.Fprint(w, "}\n"); err != nil {
 		return err
 	}
+	return w.Flush()
+}
+
+// writeNinja emits a build.ninja describing the dag: a single generic rule
+// plus one build edge per task, with <dep> translated to order-only
+// dependencies (task names are not files) and <file> translated to
+// implicit inputs. A phony="true" task is emitted against ninja's built-in
+// phony rule instead, with no command.
+func (d *dag) writeNinja(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	if _, err := fmt.Fprintf(w, "# %s\n", d.Name); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, "\n"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, "rule run\n  command = $cmd\n"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, "\n"); err != nil {
+		return err
+	}
+	for _, t := range d.Tasks {
+		rule := "run"
+		if t.Phony {
+			rule = "phony"
+		}
+		line := fmt.Sprintf("build %s: %s", t.Name, rule)
+		if len(t.Files) > 0 {
+			line += " | " + strings.Join(t.Files, " ")
+		}
+		if len(t.Deps) > 0 {
+			line += " || " + strings.Join(t.Deps, " ")
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+			return err
+		}
+		if !t.Phony {
+			if _, err := fmt.Fprintf(w, "  cmd = %s\n", t.command(d.cacheDir)); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// validate ...
+func (d *dag) validate() error {
+	if err := d.validateName(); err != nil {
+		return err
+	}
+	log.Printf("[\u001b[32mPASS\u001b[0m] check dag '%s' name", d.Name)
+	if err := d.validateTaskCount(); err != nil {
+		return err
+	}
+	log.Printf("[\u001b[32mPASS\u001b[0m] check dag '%s' task count", d.Name)
+	if err := d.validateTaskNames(); err != nil {
+		return err
+	}
+	log.Printf("[\u001b[32mPASS\u001b[0m] check dag '%s' task names", d.Name)
+	for _, t := range d.Tasks {
+		if err := t.validateName(); err != nil {
+			return err
+		}
+		log.Printf("[\u001b[32mPASS\u001b[0m] check task '%s' name", t.Name)
+		if err := t.validateCmd(); err != nil {
+			return err
+		}
+		log.Printf("[\u001b[32mPASS\u001b[0m] check task '%s' command", t.Name)
+		if err := t.validateFiles(); err != nil {
+			return err
+		}
+		for _, f := range t.Files {
+			log.Printf("[\u001b[32mPASS\u001b[0m] check task '%s' file '%s'", t.Name, f)
+		}
+		if err := t.validateFetches(); err != nil {
+			return err
+		}
+		for _, ft := range t.Fetches {
+			log.Printf("[\u001b[32mPASS\u001b[0m] check task '%s' fetch '%s'", t.Name, ft.As)
+		}
+		if err := d.validateTaskDeps(t); err != nil {
+			return err
+		}
+		for _, dep := range t.Deps {
+			log.Printf("[\u001b[32mPASS\u001b[0m] check task '%s' dependency '%s'", t.Name, dep)
+		}
+	}
+	if err := d.validateNoCircularDependency(); err != nil {
+		return err
+	}
+	log.Printf("[\u001b[32mPASS\u001b[0m] check dag '%s' for circular dependency", d.Name)
+	return nil
+}
+
+// validateName ...
+func (d *dag) validateName() error {
+	if d.Name == "" {
+		return errors.New("[\u001b[31mFAIL\u001b[0m] dag name attribute must be set")
+	}
+	return nil
+}
+
+// validateTaskCount ...
+func (d *dag) validateTaskCount() error {
+	if len(d.Tasks) == 0 {
+		return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] dag '%s' has no tasks", d.Name)
+	}
+	return nil
+}
+
+// validateTaskNames ...
+func (d *dag) validateTaskNames() error {
+	taskNames := map[string]struct{}{}
+	for _, t := range d.Tasks {
+		if _, exists := taskNames[t.Name]; exists {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] two tasks have the same name '%s'", t.Name)
+		}
+		taskNames[t.Name] = struct{}{}
+	}
+	return nil
+}
+
+// validateTaskDeps ...
+func (d *dag) validateTaskDeps(t *task) error {
+	tasks := map[string]*task{}
+	for _, t2 := range d.Tasks {
+		tasks[t2.Name] = t2
+	}
+	for _, dep := range t.Deps {
+		t2, ok := tasks[dep]
+		if !ok {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' depends on missing task '%s'", t.Name, dep)
+		}
+		if t == t2 {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' depends on itself", t.Name)
+		}
+	}
+	return nil
+}
+
+// findTask returns the task with the given name, or nil if no such task
+// exists.
+func (d *dag) findTask(name string) *task {
+	for _, t := range d.Tasks {
+		if t.Name == name {
+			return t
+		}
+	}
 	return nil
 }
 
 // circularDependecyCheck ...
 // Kahn's algorithm
-func (d *dag) circularDependencyCheck() error {
+func (d *dag) validateNoCircularDependency() error {
 	edges := []*edge{}
 	for _, t := range d.Tasks {
 		edges = append(edges, t.parentEdges()...)
@@ -84,13 +243,17 @@ func (d *dag) circularDependencyCheck() error {
 		for _, edge := range edges {
 			path = fmt.Sprintf("%s, (%s) -> (%s)", path, edge.child.Name, edge.parent.Name)
 		}
-		return fmt.Errorf("detected circular dependency %s", path)
+		return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] detected circular dependency %s", path)
 	}
 	return nil
 }
 
-// exec ...
-func (d *dag) exec(workers int) {
+// run executes the dag's tasks across workers parallel workers. ctx is
+// cancelled on SIGINT/SIGTERM, in which case in-flight tasks are given
+// shutdownTimeout to exit gracefully before being killed, and those tasks and
+// any queued task that never got to run are marked cancelled rather than
+// failed. Tasks downstream of a cancelled task are not marked.
+func (d *dag) run(ctx context.Context, workers int, retry string, shutdownTimeout time.Duration) error {
 	var wg sync.WaitGroup
 	wg.Add(len(d.Tasks))
 	queue := make(chan *task, len(d.Tasks))
@@ -100,61 +263,243 @@ func (d *dag) exec(workers int) {
 		}
 	}
 	var lock sync.Mutex
+	settled := map[*task]bool{}
 	for i := 0; i < workers; i++ {
-		go func(lock *sync.Mutex, queue chan *task) {
-			for true {
-				t := <-queue
-				var err error
-				if t.skip {
-					log.Printf("[\u001b[34mSKIPPED\u001b[0m] %s (%s)", t.Name, t.command())
-				} else {
-					log.Printf("[\u001b[33mRUNNING\u001b[0m] %s (%s)", t.Name, t.command())
-					if err = t.exec(); err == nil {
-						log.Printf("[\u001b[32mSUCCESS\u001b[0m] %s", t.Name)
-					}
-				}
-				lock.Lock()
-				if err == nil {
-					t.Success = true
-					for _, child := range t.children {
-						if child.isReady() {
-							queue <- child
-						}
-					}
-					wg.Done()
-				} else {
-					for i := 0; i < t.countChildren()+1; i++ {
-						wg.Done()
-					}
+		go worker(ctx, d, &wg, &lock, queue, shutdownTimeout, settled)
+	}
+	wg.Wait()
+	errs := []error{}
+	cancelled := false
+	for _, t := range d.Tasks {
+		if t.isReady() && !t.Success {
+			if t.Cancelled {
+				cancelled = true
+				continue
+			}
+			errs = append(errs, fmt.Errorf("[ \u001b[31mERROR\u001b[0m ] %s", t.Name))
+		}
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+	}
+	if len(errs) > 0 || cancelled {
+		if err := d.writeRetry(retry); err != nil {
+			return err
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if len(errs) == 0 {
+			return fmt.Errorf("Cancelled (resumable dag stored in %s)", path.Join(wd, retry))
+		}
+		return fmt.Errorf("Failure (resumable dag stored in %s)", path.Join(wd, retry))
+	}
+	return nil
+}
+
+// writeRetry ...
+func (d *dag) writeRetry(retry string) error {
+	f, err := os.Create(retry)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// worker pulls tasks off queue and executes them until the dag is
+// exhausted. Once ctx is cancelled, a task it has not yet started is marked
+// cancelled instead of run, draining the queue; a task already in flight is
+// left to exec to terminate gracefully.
+func worker(ctx context.Context, d *dag, wg *sync.WaitGroup, lock *sync.Mutex, queue chan *task, shutdownTimeout time.Duration, settled map[*task]bool) {
+	for t := range queue {
+		var err error
+		start := time.Now()
+		if ctx.Err() != nil {
+			log.Printf("[\u001b[36mCANCELLED\u001b[0m] %s", t.Name)
+			lock.Lock()
+			t.Cancelled = true
+			for _, child := range t.allChildren() {
+				settle(child, settled, wg)
+			}
+			settle(t, settled, wg)
+			lock.Unlock()
+			continue
+		}
+		if t.Phony {
+			log.Printf("[\u001b[35mPHONY\u001b[0m] %s", t.Name)
+		} else if t.skip {
+			log.Printf("[\u001b[34mSKIPPED\u001b[0m] %s (%s)", t.Name, t.command(d.cacheDir))
+		} else {
+			log.Printf("[\u001b[33mRUNNING\u001b[0m] %s (%s)", t.Name, t.command(d.cacheDir))
+			if err = t.exec(ctx, d.cacheDir, shutdownTimeout); err == nil {
+				log.Printf("[\u001b[32mSUCCESS\u001b[0m] %s", t.Name)
+			}
+		}
+		lock.Lock()
+		switch {
+		case err == nil:
+			t.Success = true
+			if !t.skip && !t.Phony {
+				d.recordBuildLog(t, start, time.Since(start))
+			}
+			for _, child := range t.children {
+				if child.isReady() {
+					queue <- child
 				}
-				lock.Unlock()
 			}
-		}(&lock, queue)
+		case ctx.Err() != nil:
+			t.Cancelled = true
+			log.Printf("[\u001b[36mCANCELLED\u001b[0m] %s", t.Name)
+			for _, child := range t.allChildren() {
+				settle(child, settled, wg)
+			}
+		default:
+			for _, child := range t.allChildren() {
+				settle(child, settled, wg)
+			}
+		}
+		settle(t, settled, wg)
+		lock.Unlock()
 	}
-	wg.Wait()
 }
 
-// listErrors ...
-func (d *dag) listErrors() []error {
-	errors := []error{}
-	for _, t := range d.Tasks {
-		if t.isReady() && !t.Success {
-			errors = append(errors, fmt.Errorf("[ \u001b[31mERROR\u001b[0m ] %s", t.Name))
+// settle marks t as accounted for in wg exactly once, so that when several
+// failed or cancelled tasks share downstream descendants (e.g. a fan-in
+// node), each descendant's wg.Done is only called by whichever of them
+// reaches it first. Callers must hold the dag's lock.
+func settle(t *task, settled map[*task]bool, wg *sync.WaitGroup) {
+	if settled[t] {
+		return
+	}
+	settled[t] = true
+	wg.Done()
+}
+
+// recordBuildLog persists a successful task execution to the dag's build
+// log, so a future run with identical command and inputs can skip it.
+func (d *dag) recordBuildLog(t *task, start time.Time, duration time.Duration) {
+	if d.buildLogPath == "" {
+		return
+	}
+	rec := &buildLogRecord{
+		Name:        t.Name,
+		CommandHash: t.commandHash(d.cacheDir),
+		Start:       start,
+		Duration:    duration,
+	}
+	inputHash, err := t.inputHash(d.cacheDir)
+	if err != nil {
+		log.Printf("[\u001b[31mFAIL\u001b[0m] could not hash inputs of task '%s': %v", t.Name, err)
+		return
+	}
+	rec.InputHash = inputHash
+	if d.buildLog == nil {
+		d.buildLog = buildLog{}
+	}
+	d.buildLog[t.Name] = rec
+	if err := d.buildLog.save(d.buildLogPath); err != nil {
+		log.Printf("[\u001b[31mFAIL\u001b[0m] could not write build log '%s': %v", d.buildLogPath, err)
+	}
+}
+
+// newDag parses a dag from in and loads its build log from buildLogPath (an
+// empty buildLogPath disables the build log, e.g. in tests). A task whose
+// command and input hashes match its last successful build log record is
+// marked skip, exactly like a task resumed from a .retry file.
+func newDag(in io.Reader, buildLogPath, cacheDir string) (*dag, error) {
+	r := bufio.NewReader(in)
+	dec := xml.NewDecoder(r)
+	d := dag{buildLogPath: buildLogPath, cacheDir: cacheDir}
+	if err := dec.Decode(&d); err != nil {
+		return nil, err
+	}
+	bl, err := loadBuildLog(buildLogPath)
+	if err != nil {
+		return nil, err
+	}
+	d.buildLog = bl
+	for _, t1 := range d.Tasks {
+		t1.skip = false
+		if t1.Success {
+			t1.skip = true
+		}
+		if rec, ok := bl[t1.Name]; ok && rec.matches(t1, cacheDir) {
+			t1.skip = true
+		}
+		t1.Success = false
+		t1.Cancelled = false
+		t1.children = []*task{}
+		t1.parents = []*task{}
+		for _, t2 := range d.Tasks {
+			for _, dep := range t1.Deps {
+				if dep == t2.Name {
+					t1.parents = append(t1.parents, t2)
+				}
+			}
+			for _, dep := range t2.Deps {
+				if dep == t1.Name {
+					t1.children = append(t1.children, t2)
+				}
+			}
 		}
 	}
-	return errors
+	return &d, nil
 }
 
 // task ...
 type task struct {
-	Cmd      string   `xml:"cmd"`
-	Deps     []string `xml:"dep"`
-	Files    []string `xml:"file"`
-	Name     string   `xml:"name,attr"`
-	Success  bool     `xml:"success"`
-	skip     bool
-	children []*task
-	parents  []*task
+	Cmd       string    `xml:"cmd"`
+	Deps      []string  `xml:"dep"`
+	IfCreate  []string  `xml:"dep-ifcreate"`
+	Always    *struct{} `xml:"dep-always"`
+	Files     []string  `xml:"file"`
+	Fetches   []*fetch  `xml:"fetch"`
+	Name      string    `xml:"name,attr"`
+	Phony     bool      `xml:"phony,attr"`
+	Success   bool      `xml:"success"`
+	Cancelled bool      `xml:"cancelled"`
+	skip      bool
+	children  []*task
+	parents   []*task
+}
+
+// validateName ...
+func (t *task) validateName() error {
+	if t.Name == "" {
+		return errors.New("[\u001b[31mFAIL\u001b[0m] task name attribute must be set")
+	}
+	return nil
+}
+
+// validateCmd ...
+func (t *task) validateCmd() error {
+	if t.Cmd == "" && !t.Phony {
+		return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' has no command set", t.Name)
+	}
+	return nil
+
+}
+
+// validateFiles ...
+func (t *task) validateFiles() error {
+	for _, f := range t.Files {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' requires missing file '%s'", t.Name, f)
+		}
+	}
+	return nil
 }
 
 // parentEdges ...
@@ -175,27 +520,46 @@ func (t *task) isReady() bool {
 	return true
 }
 
-func (t *task) countChildren() int {
-	n := 0
+func (t *task) allChildren() []*task {
+	set := map[string]*task{}
 	for _, child := range t.children {
-		n = n + 1 + child.countChildren()
+		set[child.Name] = child
+		for _, grandChild := range child.allChildren() {
+			set[grandChild.Name] = grandChild
+		}
+	}
+	children := []*task{}
+	for _, child := range set {
+		children = append(children, child)
 	}
-	return n
+	return children
 }
 
-func (t *task) command() string {
-	files := make([]interface{}, len(t.Files))
-	for i, f := range t.Files {
-		files[i] = f
+// command renders the task's command, substituting the %s placeholders
+// with the <file> paths followed by the cache-resolved local path of
+// each <fetch> artifact, in declaration order.
+func (t *task) command(cacheDir string) string {
+	files := make([]interface{}, 0, len(t.Files)+len(t.Fetches))
+	for _, f := range t.Files {
+		files = append(files, f)
+	}
+	for _, ft := range t.Fetches {
+		files = append(files, ft.path(cacheDir))
 	}
 	return fmt.Sprintf(t.Cmd, files...)
 }
 
-// exec ...
-func (t *task) exec() error {
-	args := strings.Fields(t.command())
+// exec runs the task's command in its own process group so that, if ctx is
+// cancelled mid-run, the whole group can be signalled rather than just the
+// direct child.
+func (t *task) exec(ctx context.Context, cacheDir string, shutdownTimeout time.Duration) error {
+	if err := t.ensureFetches(ctx, cacheDir); err != nil {
+		return err
+	}
+	args := strings.Fields(t.command(cacheDir))
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Env = append(os.Environ())
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -222,51 +586,60 @@ func (t *task) exec() error {
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	for i := 0; i < 2; i++ {
-		if err := <-errc; err != nil {
-			return err
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := <-errc; err != nil {
+				done <- err
+				return
+			}
 		}
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return t.terminate(cmd, done, shutdownTimeout)
 	}
-	return cmd.Wait()
 }
 
-// edge ...
-type edge struct {
-	child  *task
-	parent *task
+// terminate sends SIGTERM to cmd's entire process group, waits up to
+// shutdownTimeout for it to exit, and escalates to SIGKILL if it hasn't.
+func (t *task) terminate(cmd *exec.Cmd, done chan error, shutdownTimeout time.Duration) error {
+	pgid := cmd.Process.Pid
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		<-done
+	}
+	return fmt.Errorf("[\u001b[36mCANCELLED\u001b[0m] %s", t.Name)
 }
 
-// newDag ...
-func newDag(filename string) (*dag, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// ensureFetches downloads and verifies every fetch artifact the task
+// declares that isn't already cached with a matching sha256, so exec can
+// assume they're present on disk before it renders the command. ctx
+// cancellation aborts an in-flight download rather than blocking exec's
+// select on ctx.Done() until it finishes on its own.
+func (t *task) ensureFetches(ctx context.Context, cacheDir string) error {
+	if len(t.Fetches) == 0 {
+		return nil
 	}
-	dec := xml.NewDecoder(f)
-	d := dag{}
-	if err = dec.Decode(&d); err != nil {
-		return nil, err
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
 	}
-	for _, t1 := range d.Tasks {
-		t1.skip = false
-		if t1.Success {
-			t1.skip = true
-		}
-		t1.Success = false
-		t1.children = []*task{}
-		t1.parents = []*task{}
-		for _, t2 := range d.Tasks {
-			for _, dep := range t1.Deps {
-				if dep == t2.Name {
-					t1.parents = append(t1.parents, t2)
-				}
-			}
-			for _, dep := range t2.Deps {
-				if dep == t1.Name {
-					t1.children = append(t1.children, t2)
-				}
-			}
+	for _, ft := range t.Fetches {
+		if err := ft.ensure(ctx, cacheDir); err != nil {
+			return err
 		}
 	}
-	return &d, nil
+	return nil
+}
+
+// edge ...
+type edge struct {
+	child  *task
+	parent *task
 }
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var input = `
+<dag name="test_dag">
+  <task name="test_task_1">
+    <file>test_task_1.py</file>
+    <cmd>python %s</cmd>
+  </task>
+  <task name="test_task_2">
+    <file>test_task_2.py</file>
+    <cmd>python %s</cmd>
+  </task>
+  <task name="test_task_3">
+    <dep>test_task_1</dep>
+    <dep>test_task_2</dep>
+    <file>test_task_3.py</file>
+    <cmd>python %s</cmd>
+  </task>
+  <task name="test_task_4">
+    <dep>test_task_3</dep>
+    <file>test_task_4.py</file>
+    <cmd>python %s</cmd>
+  </task>
+  <task name="test_task_5">
+    <dep>test_task_1</dep>
+    <dep>test_task_3</dep>
+    <file>test_task_5.py</file>
+    <cmd>python %s</cmd>
+  </task>
+</dag>
+`
+
+var expected = &dag{
+	Name: "test_dag",
+	Tasks: []*task{
+		&task{
+			Cmd:   "python %s",
+			Deps:  []string{},
+			Files: []string{"test_task_1.py"},
+			Name:  "test_task_1",
+		},
+		&task{
+			Cmd:   "python %s",
+			Deps:  []string{},
+			Files: []string{"test_task_2.py"},
+			Name:  "test_task_2",
+		},
+		&task{
+			Cmd:   "python %s",
+			Deps:  []string{"test_task_1", "test_task_2"},
+			Files: []string{"test_task_3.py"},
+			Name:  "test_task_3",
+		},
+		&task{
+			Cmd:   "python %s",
+			Deps:  []string{"test_task_3"},
+			Files: []string{"test_task_4.py"},
+			Name:  "test_task_4",
+		},
+		&task{
+			Cmd:   "python %s",
+			Deps:  []string{"test_task_1", "test_task_3"},
+			Files: []string{"test_task_5.py"},
+			Name:  "test_task_5",
+		},
+	},
+}
+
+var expectedDot = `digraph test_dag {
+
+  test_task_1 [label="test_task_1"];
+  test_task_2 [label="test_task_2"];
+  test_task_3 [label="test_task_3"];
+  test_task_1 -> test_task_3;
+  test_task_2 -> test_task_3;
+  test_task_4 [label="test_task_4"];
+  test_task_3 -> test_task_4;
+  test_task_5 [label="test_task_5"];
+  test_task_1 -> test_task_5;
+  test_task_3 -> test_task_5;
+
+}
+`
+
+var expectedNinja = `# test_dag
+
+rule run
+  command = $cmd
+
+build test_task_1: run | test_task_1.py
+  cmd = python test_task_1.py
+build test_task_2: run | test_task_2.py
+  cmd = python test_task_2.py
+build test_task_3: run | test_task_3.py || test_task_1 test_task_2
+  cmd = python test_task_3.py
+build test_task_4: run | test_task_4.py || test_task_3
+  cmd = python test_task_4.py
+build test_task_5: run | test_task_5.py || test_task_1 test_task_3
+  cmd = python test_task_5.py
+`
+
+func TestParseDag(t *testing.T) {
+	r := bytes.NewBufferString(input)
+	d, err := newDag(r, "", "")
+	if err != nil {
+		t.Errorf("newDag(r) returned error %v, want no error", err)
+	}
+	if d.Name != expected.Name {
+		t.Errorf("newDag(r) returned dag where Name='%s', wanted Name='%s'", d.Name, expected.Name)
+	}
+	if len(d.Tasks) != len(expected.Tasks) {
+		t.Errorf("newDag(r) returned dag where len(Tasks)='%d', wanted len(Tasks)='%d'", len(d.Tasks), len(expected.Tasks))
+	}
+	for i, et := range expected.Tasks {
+		if et.Cmd != d.Tasks[i].Cmd {
+			t.Errorf("newDag(r) returned dag where Tasks[%d].Cmd='%s', wanted Cmd='%s'", i, d.Tasks[i].Cmd, et.Cmd)
+		}
+		if len(et.Deps) != len(d.Tasks[i].Deps) {
+			t.Errorf("newDag(r) returned dag where len(Tasks[%d].Deps)='%d', wanted len(Deps)='%d'", i, len(d.Tasks[i].Deps), len(et.Deps))
+		} else {
+			for j, ed := range et.Deps {
+				if ed != d.Tasks[i].Deps[j] {
+					t.Errorf("newDag(r) returned dag where Tasks[%d].Deps[%d]='%s', wanted Deps[%d]='%s'", i, j, d.Tasks[i].Deps[j], j, ed)
+				}
+			}
+		}
+		if len(et.Files) != len(d.Tasks[i].Files) {
+			t.Errorf("newDag(r) returned dag where len(Tasks[%d].Files)='%d', wanted len(Files)='%d'", i, len(d.Tasks[i].Files), len(et.Files))
+		} else {
+			for j, ef := range et.Files {
+				if ef != d.Tasks[i].Files[j] {
+					t.Errorf("newDag(r) returned dag where Tasks[%d].Files[%d]='%s', wanted Files[%d]='%s'", i, j, d.Tasks[i].Files[j], j, ef)
+				}
+			}
+		}
+		if et.Name != d.Tasks[i].Name {
+			t.Errorf("newDag(r) returned dag where Tasks[%d].Name='%s', wanted Name='%s'", i, d.Tasks[i].Name, et.Name)
+		}
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	var w bytes.Buffer
+	if err := expected.writeDot(&w); err != nil {
+		t.Errorf("writeDot(w) returned error %v, want no error", err)
+	}
+	if expectedDot != w.String() {
+		t.Errorf("writeDot(w) wrote '%s' to w, wanted '%s'", w.String(), expectedDot)
+	}
+}
+
+func TestWriteNinja(t *testing.T) {
+	var w bytes.Buffer
+	if err := expected.writeNinja(&w); err != nil {
+		t.Errorf("writeNinja(w) returned error %v, want no error", err)
+	}
+	if expectedNinja != w.String() {
+		t.Errorf("writeNinja(w) wrote '%s' to w, wanted '%s'", w.String(), expectedNinja)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	d := &dag{}
+	if err := d.validateName(); err == nil {
+		t.Errorf("validateName() returned nil, want error")
+	}
+	if err := expected.validateName(); err != nil {
+		t.Errorf("validateName() returned error %v, want no error", err)
+	}
+}
+
+func TestValidateTaskCount(t *testing.T) {
+	d := &dag{}
+	if err := d.validateTaskCount(); err == nil {
+		t.Errorf("validateTaskCount() returned nil, want error")
+	}
+	if err := expected.validateTaskCount(); err != nil {
+		t.Errorf("validateTaskCount() returned error %v, want no error", err)
+	}
+}
+
+func TestValidateTaskNames(t *testing.T) {
+	d := &dag{
+		Tasks: []*task{
+			&task{
+				Name: "task1",
+			},
+			&task{
+				Name: "task1",
+			},
+		},
+	}
+	if err := d.validateTaskNames(); err == nil {
+		t.Errorf("validateTaskNames() returned nil, want error")
+	}
+	if err := expected.validateTaskNames(); err != nil {
+		t.Errorf("validateTaskNames() returned error %v, want no error", err)
+	}
+}
+
+func TestValidateTaskDeps(t *testing.T) {
+	d := &dag{
+		Tasks: []*task{
+			&task{
+				Deps: []string{"missing_task"},
+			},
+		},
+	}
+	if err := d.validateTaskDeps(d.Tasks[0]); err == nil {
+		t.Errorf("validateTaskDeps() returned nil, want error")
+	}
+	if err := expected.validateTaskDeps(expected.Tasks[3]); err != nil {
+		t.Errorf("validateTaskDeps() returned error %v, want no error", err)
+	}
+}
+
+func TestValidateNoCircularDependency(t *testing.T) {
+	task1 := &task{
+		Name: "task1",
+		Deps: []string{"task2"},
+	}
+	task2 := &task{
+		Name: "task2",
+		Deps: []string{"task1"},
+	}
+	task1.parents = []*task{task2}
+	task1.children = []*task{task2}
+	task2.parents = []*task{task1}
+	task2.children = []*task{task1}
+	d := &dag{
+		Tasks: []*task{task1, task2},
+	}
+	if err := d.validateNoCircularDependency(); err == nil {
+		t.Errorf("validateNoCircularDependency() returned nil, want error")
+	}
+	if err := expected.validateNoCircularDependency(); err != nil {
+		t.Errorf("validateNoCircularDependency() returned error %v, want no error", err)
+	}
+}
+
+func TestTaskValidateName(t *testing.T) {
+	s := &task{}
+	if err := s.validateName(); err == nil {
+		t.Errorf("validateName() returned nil, want error")
+	}
+	if err := expected.Tasks[0].validateName(); err != nil {
+		t.Errorf("validateName() returned error %v, want no error", err)
+	}
+}
+
+func TestTaskValidateCmd(t *testing.T) {
+	s := &task{}
+	if err := s.validateCmd(); err == nil {
+		t.Errorf("validateCmd() returned nil, want error")
+	}
+	phony := &task{Phony: true}
+	if err := phony.validateCmd(); err != nil {
+		t.Errorf("validateCmd() returned error %v, want no error for a phony task", err)
+	}
+	if err := expected.Tasks[0].validateCmd(); err != nil {
+		t.Errorf("validateCmd() returned error %v, want no error", err)
+	}
+}
+
+func TestBuildLogSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/test.buildlog"
+	bl := buildLog{
+		"task1": &buildLogRecord{
+			Name:        "task1",
+			CommandHash: "abc",
+			InputHash:   "def",
+			Start:       time.Now().Truncate(time.Second),
+			Duration:    2 * time.Second,
+		},
+	}
+	if err := bl.save(path); err != nil {
+		t.Fatalf("save(path) returned error %v, want no error", err)
+	}
+	loaded, err := loadBuildLog(path)
+	if err != nil {
+		t.Fatalf("loadBuildLog(path) returned error %v, want no error", err)
+	}
+	if len(loaded) != len(bl) {
+		t.Fatalf("loadBuildLog(path) returned %d records, want %d", len(loaded), len(bl))
+	}
+	rec, ok := loaded["task1"]
+	if !ok {
+		t.Fatalf("loadBuildLog(path) did not return a record for 'task1'")
+	}
+	want := bl["task1"]
+	if rec.CommandHash != want.CommandHash || rec.InputHash != want.InputHash {
+		t.Errorf("loadBuildLog(path) returned record %+v, want %+v", rec, want)
+	}
+	if !rec.Start.Equal(want.Start) {
+		t.Errorf("loadBuildLog(path) returned Start='%s', want '%s'", rec.Start, want.Start)
+	}
+	if rec.Duration != want.Duration {
+		t.Errorf("loadBuildLog(path) returned Duration='%s', want '%s'", rec.Duration, want.Duration)
+	}
+}
+
+func TestLoadBuildLogMissingFile(t *testing.T) {
+	bl, err := loadBuildLog("/does/not/exist.buildlog")
+	if err != nil {
+		t.Errorf("loadBuildLog(path) returned error %v, want no error", err)
+	}
+	if len(bl) != 0 {
+		t.Errorf("loadBuildLog(path) returned %d records, want 0", len(bl))
+	}
+}
+
+func TestValidateFetches(t *testing.T) {
+	bad := &task{Name: "t", Fetches: []*fetch{{URL: "", As: "x", SHA256: "abc"}}}
+	if err := bad.validateFetches(); err == nil {
+		t.Errorf("validateFetches() returned nil, want error")
+	}
+	good := &task{Name: "t", Fetches: []*fetch{{URL: "https://example.com/x", As: "x", SHA256: strings.Repeat("a", 64)}}}
+	if err := good.validateFetches(); err != nil {
+		t.Errorf("validateFetches() returned error %v, want no error", err)
+	}
+}
+
+func TestFetchEnsure(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("artifact contents")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer srv.Close()
+	ft := &fetch{URL: srv.URL, SHA256: hash, As: "artifact"}
+	if err := ft.ensure(context.Background(), dir); err != nil {
+		t.Fatalf("ensure(ctx, dir) returned error %v, want no error", err)
+	}
+	if requests != 1 {
+		t.Errorf("ensure(ctx, dir) made %d requests, want 1", requests)
+	}
+	got, err := os.ReadFile(ft.path(dir))
+	if err != nil {
+		t.Fatalf("ReadFile(path) returned error %v, want no error", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("ensure(ctx, dir) wrote %q, want %q", got, content)
+	}
+	if err := ft.ensure(context.Background(), dir); err != nil {
+		t.Fatalf("ensure(ctx, dir) returned error %v, want no error", err)
+	}
+	if requests != 1 {
+		t.Errorf("ensure(dir) made %d requests on cache hit, want 1", requests)
+	}
+}
+
+func TestFetchEnsureCancellation(t *testing.T) {
+	dir := t.TempDir()
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(block)
+	}))
+	defer srv.Close()
+	ft := &fetch{URL: srv.URL, SHA256: strings.Repeat("a", 64), As: "artifact"}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- ft.ensure(ctx, dir) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("ensure(ctx, dir) returned nil, want error since ctx was cancelled mid-download")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ensure(ctx, dir) did not return after ctx cancellation")
+	}
+	<-block
+}
+
+func TestBuildLogRecordMatches(t *testing.T) {
+	dir := t.TempDir()
+	file := dir + "/input.txt"
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile(file) returned error %v, want no error", err)
+	}
+	tsk := &task{Cmd: "python %s", Files: []string{file}}
+	inputHash, err := tsk.inputHash("")
+	if err != nil {
+		t.Fatalf("inputHash(\"\") returned error %v, want no error", err)
+	}
+	rec := &buildLogRecord{CommandHash: tsk.commandHash(""), InputHash: inputHash}
+	if !rec.matches(tsk, "") {
+		t.Errorf("matches(tsk, \"\") returned false, want true")
+	}
+	if err := os.WriteFile(file, []byte("changed"), 0644); err != nil {
+		t.Fatalf("WriteFile(file) returned error %v, want no error", err)
+	}
+	if rec.matches(tsk, "") {
+		t.Errorf("matches(tsk, \"\") returned true, want false")
+	}
+}
+
+func TestWriteNinjaPhony(t *testing.T) {
+	d := &dag{
+		Name: "phony_dag",
+		Tasks: []*task{
+			&task{Name: "build", Cmd: "make"},
+			&task{Name: "all", Deps: []string{"build"}, Phony: true},
+		},
+	}
+	var w bytes.Buffer
+	if err := d.writeNinja(&w); err != nil {
+		t.Errorf("writeNinja(w) returned error %v, want no error", err)
+	}
+	want := "build all: phony || build\n"
+	if !strings.Contains(w.String(), want) {
+		t.Errorf("writeNinja(w) wrote %q, want it to contain %q", w.String(), want)
+	}
+}
+
+func TestBuildLogRecordMatchesAlwaysRerun(t *testing.T) {
+	tsk := &task{Cmd: "python %s", Always: &struct{}{}}
+	rec := &buildLogRecord{CommandHash: tsk.commandHash("")}
+	if rec.matches(tsk, "") {
+		t.Errorf("matches(tsk, \"\") returned true, want false for a task with a dep-always edge")
+	}
+}
+
+func TestInputHashIfCreate(t *testing.T) {
+	dir := t.TempDir()
+	p := dir + "/created-later"
+	tsk := &task{Cmd: "python %s", IfCreate: []string{p}}
+	before, err := tsk.inputHash("")
+	if err != nil {
+		t.Fatalf("inputHash(\"\") returned error %v, want no error", err)
+	}
+	if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+		t.Fatalf("WriteFile(p) returned error %v, want no error", err)
+	}
+	after, err := tsk.inputHash("")
+	if err != nil {
+		t.Fatalf("inputHash(\"\") returned error %v, want no error", err)
+	}
+	if before == after {
+		t.Errorf("inputHash(\"\") did not change once the dep-ifcreate path was created")
+	}
+}
+
+func TestInputHashFetchPinChange(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/artifact", []byte("stale bytes"), 0644); err != nil {
+		t.Fatalf("WriteFile(dir) returned error %v, want no error", err)
+	}
+	tsk := &task{Cmd: "python %s", Fetches: []*fetch{{URL: "https://example.com/x", SHA256: strings.Repeat("a", 64), As: "artifact"}}}
+	before, err := tsk.inputHash(dir)
+	if err != nil {
+		t.Fatalf("inputHash(dir) returned error %v, want no error", err)
+	}
+	tsk.Fetches[0].SHA256 = strings.Repeat("b", 64)
+	after, err := tsk.inputHash(dir)
+	if err != nil {
+		t.Fatalf("inputHash(dir) returned error %v, want no error", err)
+	}
+	if before == after {
+		t.Errorf("inputHash(dir) did not change when the fetch's sha256 pin changed, even though the cached bytes did not")
+	}
+}
+
+func TestRunCancellationFanIn(t *testing.T) {
+	input := `
+<dag name="fanin_dag">
+  <task name="task1">
+    <cmd>sleep 2</cmd>
+  </task>
+  <task name="task2">
+    <cmd>sleep 2</cmd>
+  </task>
+  <task name="task3">
+    <dep>task1</dep>
+    <dep>task2</dep>
+    <cmd>true</cmd>
+  </task>
+</dag>
+`
+	d, err := newDag(bytes.NewBufferString(input), "", "")
+	if err != nil {
+		t.Fatalf("newDag(r, \"\", \"\") returned error %v, want no error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	retry := t.TempDir() + "/fanin.retry"
+	if err := d.run(ctx, 2, retry, 200*time.Millisecond); err == nil {
+		t.Errorf("run(ctx, 2, retry, timeout) returned nil, want an error since task1 and task2 were both cancelled mid-flight")
+	}
+}
+
+func TestTaskExecCancellation(t *testing.T) {
+	dir := t.TempDir()
+	script := dir + "/sleeper.sh"
+	body := "#!/bin/sh\ntrap '' TERM\nsleep 5\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatalf("WriteFile(script) returned error %v, want no error", err)
+	}
+	tsk := &task{Name: "sleeper", Cmd: script}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- tsk.exec(ctx, "", 50*time.Millisecond) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("exec(ctx, \"\", timeout) returned nil, want error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("exec(ctx, \"\", timeout) did not return after cancellation")
+	}
+}
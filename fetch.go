@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+)
+
+// fetch is a pinned remote artifact a task downloads into the cache
+// directory before it runs, e.g. <fetch url="https://..." sha256="..."
+// as="local-name"/>.
+type fetch struct {
+	URL    string `xml:"url,attr"`
+	SHA256 string `xml:"sha256,attr"`
+	As     string `xml:"as,attr"`
+}
+
+// path returns the local path a fetch resolves to once cached.
+func (ft *fetch) path(cacheDir string) string {
+	return path.Join(cacheDir, ft.As)
+}
+
+// validateFetches ...
+func (t *task) validateFetches() error {
+	for _, ft := range t.Fetches {
+		if ft.URL == "" {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' has a fetch with no url set", t.Name)
+		}
+		if ft.As == "" {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' has a fetch with no 'as' set", t.Name)
+		}
+		if len(ft.SHA256) != 64 {
+			return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] task '%s' fetch '%s' has an invalid sha256 attribute", t.Name, ft.As)
+		}
+	}
+	return nil
+}
+
+// ensure downloads the fetch into cacheDir unless a file already cached
+// under its 'as' name already matches the pinned sha256. ctx cancellation
+// aborts an in-flight download promptly instead of leaving it to run to
+// completion.
+func (ft *fetch) ensure(ctx context.Context, cacheDir string) error {
+	dst := ft.path(cacheDir)
+	if hash, err := hashFile(dst); err == nil && hash == ft.SHA256 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ft.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] fetch '%s' returned status %s", ft.As, resp.Status)
+	}
+	tmp, err := os.CreateTemp(cacheDir, ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != ft.SHA256 {
+		return fmt.Errorf("[\u001b[31mFAIL\u001b[0m] fetch '%s' sha256 mismatch: got '%s', want '%s'", ft.As, sum, ft.SHA256)
+	}
+	return os.Rename(tmp.Name(), dst)
+}